@@ -0,0 +1,220 @@
+package rsync
+
+import (
+	"bytes"
+	"hash"
+	"io"
+)
+
+// CDCConfig parameterizes the content-defined chunk splitter used by
+// CreateCDCSignature and CreateCDCDelta. Average, Min, and Max are all
+// measured in bytes.
+type CDCConfig struct {
+	Average int
+	Min     int
+	Max     int
+}
+
+// normalize fills in Min/Max from Average when the caller left them unset,
+// using the avg/4 .. avg*8 bounds recommended for Rabin-style splitters.
+func (c CDCConfig) normalize() CDCConfig {
+	if c.Min <= 0 {
+		c.Min = c.Average / 4
+	}
+	if c.Max <= 0 {
+		c.Max = c.Average * 8
+	}
+	return c
+}
+
+// mask returns the bitmask a rolling hash is compared against to decide a
+// chunk boundary, sized so that boundaries occur roughly every Average
+// bytes.
+func (c CDCConfig) mask() uint64 {
+	bits := 0
+	for avg := c.Average; avg > 1; avg >>= 1 {
+		bits++
+	}
+	return 1<<uint(bits) - 1
+}
+
+const cdcWindow = 64
+
+// cdcWindowBits is log2(cdcWindow); roll subtracts the byte leaving the
+// window shifted left by this many bits.
+const cdcWindowBits = 6
+
+// cdcMagic is compared against the rolling hash, masked, to decide whether
+// the current position is a chunk boundary.
+const cdcMagic = 0
+
+// rollingBuzhash implements a shift-and-add rolling hash
+// (h = h<<1 + in - out<<cdcWindowBits) over a fixed window, used to find content-defined chunk boundaries independent of any
+// surrounding insertions or deletions.
+type rollingBuzhash struct {
+	window []byte
+	pos    int
+	full   bool
+	h      uint64
+}
+
+func newRollingBuzhash() *rollingBuzhash {
+	return &rollingBuzhash{window: make([]byte, cdcWindow)}
+}
+
+// roll feeds one byte into the window, returning the updated hash.
+func (r *rollingBuzhash) roll(in byte) uint64 {
+	out := r.window[r.pos]
+	r.window[r.pos] = in
+	r.pos = (r.pos + 1) % cdcWindow
+	if r.pos == 0 {
+		r.full = true
+	}
+	r.h = (r.h << 1) + uint64(in)
+	if r.full {
+		r.h -= uint64(out) << cdcWindowBits
+	}
+	return r.h
+}
+
+// cdcSplit scans data and returns the offsets, relative to data, at which a
+// chunk boundary falls under cfg.
+func cdcSplit(data []byte, cfg CDCConfig) []int {
+	cfg = cfg.normalize()
+	mask := cfg.mask()
+	var bounds []int
+	start := 0
+	roll := newRollingBuzhash()
+	for i, c := range data {
+		size := i - start + 1
+		roll.roll(c)
+		if size < cfg.Min {
+			continue
+		}
+		if size >= cfg.Max || roll.h&mask == cdcMagic {
+			bounds = append(bounds, i+1)
+			start = i + 1
+			roll = newRollingBuzhash()
+		}
+	}
+	if start < len(data) {
+		bounds = append(bounds, len(data))
+	}
+	return bounds
+}
+
+// CreateCDCSignature splits basis into content-defined chunks instead of
+// fixed-size blocks, so that an insertion or deletion only invalidates the
+// chunks touching the edit rather than every subsequent block boundary.
+// Chunk boundaries, rather than a uniform BlockSize, define each chunk's
+// extent, which its ChunkHash records as Offset and Length.
+func (rs *RSync) CreateCDCSignature(basis io.Reader, cfg CDCConfig, blockHandler func(block ChunkHash) error) error {
+	newHash := rs.strongHasher()
+	h := newHash()
+	data, err := io.ReadAll(basis)
+	if err != nil {
+		return err
+	}
+	var offset int
+	var index uint64
+	for _, end := range cdcSplit(data, cfg) {
+		chunk := data[offset:end]
+		weak, _ := weakChecksum(chunk)
+		h.Reset()
+		h.Write(chunk)
+		if err := blockHandler(ChunkHash{
+			Index:      index,
+			Offset:     uint64(offset),
+			Length:     uint32(len(chunk)),
+			WeakHash:   weak,
+			StrongHash: h.Sum(nil),
+		}); err != nil {
+			return err
+		}
+		offset = end
+		index++
+	}
+	return nil
+}
+
+// ChunkHash is the signature record for one variable-length CDC chunk.
+type ChunkHash struct {
+	Index      uint64
+	Offset     uint64
+	Length     uint32
+	StrongHash []byte
+	WeakHash   uint32
+}
+
+// CreateCDCDelta diffs newfile against the variable-length chunks in cl,
+// matching on (WeakHash, StrongHash, Length) since CDC chunks, unlike fixed
+// blocks, are not all the same size.
+func (rs *RSync) CreateCDCDelta(newfile io.Reader, cl []ChunkHash, cfg CDCConfig, opHandler func(op Operation) error, hasher hash.Hash) error {
+	lookup := make(map[uint32][]ChunkHash, len(cl))
+	for _, c := range cl {
+		lookup[c.WeakHash] = append(lookup[c.WeakHash], c)
+	}
+	newHash := rs.strongHasher()
+	h := newHash()
+
+	data, err := io.ReadAll(newfile)
+	if err != nil {
+		return err
+	}
+	if hasher != nil {
+		hasher.Write(data)
+	}
+
+	var literal []byte
+	flush := func() error {
+		for len(literal) > 0 {
+			n := len(literal)
+			if rs.MaxDataOp > 0 && n > rs.MaxDataOp {
+				n = rs.MaxDataOp
+			}
+			if err := opHandler(Operation{Type: DATA, Data: literal[:n]}); err != nil {
+				return err
+			}
+			literal = literal[n:]
+		}
+		return nil
+	}
+
+	offset := 0
+	for _, end := range cdcSplit(data, cfg) {
+		chunk := data[offset:end]
+		matched := false
+		if candidates, ok := lookup[weakOf(chunk)]; ok {
+			h.Reset()
+			h.Write(chunk)
+			strong := h.Sum(nil)
+			for _, c := range candidates {
+				if int(c.Length) == len(chunk) && bytes.Equal(c.StrongHash, strong) {
+					if err := flush(); err != nil {
+						return err
+					}
+					if err := opHandler(Operation{
+						Type:        BLOCK,
+						BlockIndex:  c.Index,
+						BlockOffset: c.Offset,
+						BlockLength: c.Length,
+					}); err != nil {
+						return err
+					}
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			literal = append(literal, chunk...)
+		}
+		offset = end
+	}
+	return flush()
+}
+
+func weakOf(b []byte) uint32 {
+	w, _ := weakChecksum(b)
+	return w
+}
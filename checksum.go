@@ -0,0 +1,31 @@
+package rsync
+
+// weakChecksumAB computes the classic rsync rolling checksum's two
+// components, a and b, of block from scratch. Callers that need to slide
+// the window forward one byte at a time should instead seed a, b from here
+// once and call rollChecksum, which is O(1) per byte rather than O(len(block)).
+func weakChecksumAB(block []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a, b
+}
+
+// weakChecksum computes the classic rsync rolling checksum of block,
+// returning the combined checksum (a | (b << 16)) alongside its a
+// component alone.
+func weakChecksum(block []byte) (uint32, uint32) {
+	a, b := weakChecksumAB(block)
+	return a | (b << 16), a
+}
+
+// rollChecksum slides the rsync weak checksum window forward by one byte:
+// out leaves the window, in enters it, and blockSize is the window width.
+func rollChecksum(a, b uint32, out, in byte, blockSize int) (uint32, uint32) {
+	a = a - uint32(out) + uint32(in)
+	b = b - uint32(blockSize)*uint32(out) + a
+	return a, b
+}
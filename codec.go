@@ -0,0 +1,25 @@
+package rsync
+
+import "io"
+
+// SigCodec encodes and decodes a fixed-block-size signature in a specific
+// on-disk wire format. Selecting a codec is how a caller chooses between
+// this package's native gob encoding and byte-compatible interop with
+// another rsync implementation (e.g. librsync's .rs files).
+type SigCodec interface {
+	EncodeSignature(w io.Writer, rs *RSync, blocks []BlockHash) error
+	DecodeSignature(r io.Reader) (*RSync, []BlockHash, error)
+}
+
+// DeltaCodec encodes and decodes a delta stream in a specific on-disk wire
+// format, mirroring SigCodec. sourceSum, when non-nil, is the whole-file
+// strong checksum of the file the delta reconstructs; codecs that have no
+// wire representation for it (librsync has none) may silently drop it on
+// encode and always return a nil sourceSum on decode. ops passed to
+// EncodeDelta may include a trailing Operation{Type: MAC}; DecodeDelta pulls
+// it back out and returns it separately as mac, again nil wherever the
+// format has no representation for it.
+type DeltaCodec interface {
+	EncodeDelta(w io.Writer, rs *RSync, ops []Operation, sourceSum []byte) error
+	DecodeDelta(r io.Reader) (rs *RSync, ops []Operation, sourceSum []byte, mac []byte, err error)
+}
@@ -0,0 +1,108 @@
+package rsync
+
+import (
+	"encoding/gob"
+	"io"
+)
+
+// gobHeader is the first value written to a native-format signature or
+// delta stream.
+type gobHeader struct {
+	BlockSize int
+	HashID    HashID
+}
+
+// GobSigCodec is this package's native signature format: a gob-encoded
+// header followed by one gob-encoded BlockHash per basis block.
+type GobSigCodec struct{}
+
+func (GobSigCodec) EncodeSignature(w io.Writer, rs *RSync, blocks []BlockHash) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(gobHeader{BlockSize: rs.BlockSize, HashID: rs.HashID}); err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err := enc.Encode(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (GobSigCodec) DecodeSignature(r io.Reader) (*RSync, []BlockHash, error) {
+	dec := gob.NewDecoder(r)
+	var header gobHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, err
+	}
+	rs := &RSync{BlockSize: header.BlockSize, HashID: header.HashID}
+	var blocks []BlockHash
+	for {
+		var b BlockHash
+		err := dec.Decode(&b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return rs, blocks, nil
+}
+
+// GobDeltaCodec is this package's native delta format: a gob-encoded
+// header, one gob-encoded Operation per delta step (which may include a
+// trailing Operation{Type: MAC}, appended by the caller), and (when
+// sourceSum is given) a trailing Operation{Type: HASH} carrying it.
+type GobDeltaCodec struct{}
+
+func (GobDeltaCodec) EncodeDelta(w io.Writer, rs *RSync, ops []Operation, sourceSum []byte) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(gobHeader{BlockSize: rs.BlockSize, HashID: rs.HashID}); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			return err
+		}
+	}
+	if sourceSum != nil {
+		if err := enc.Encode(Operation{Type: HASH, Data: sourceSum}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (GobDeltaCodec) DecodeDelta(r io.Reader) (*RSync, []Operation, []byte, []byte, error) {
+	dec := gob.NewDecoder(r)
+	var header gobHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	rs := &RSync{BlockSize: header.BlockSize, HashID: header.HashID}
+	var ops []Operation
+	var sourceSum []byte
+	var mac []byte
+	for {
+		var op Operation
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if op.Type == HASH {
+			sourceSum = op.Data
+			continue
+		}
+		if op.Type == MAC {
+			mac = op.Data
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return rs, ops, sourceSum, mac, nil
+}
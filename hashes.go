@@ -0,0 +1,38 @@
+package rsync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+
+// HashID identifies the strong-hash algorithm a signature or delta was built
+// with, so it can be persisted in a wire header and a later patch can
+// reconstruct a matching hasher without being told again.
+type HashID byte
+
+const (
+	// HashMD5 is the default, matching the MD5 strong hash RSync uses
+	// when UniqueHasher is nil.
+	HashMD5 HashID = iota
+	HashSHA256
+)
+
+// ErrUnsupportedHash is returned by NewHasher for a HashID this package does
+// not recognize, e.g. one written by a future version of this tool with a
+// hash this package cannot build without an external dependency.
+var ErrUnsupportedHash = errors.New("rsync: unsupported hash algorithm (requires an external dependency not vendored by this package)")
+
+// NewHasher returns a constructor for the strong hash identified by id,
+// suitable for RSync.UniqueHasher.
+func NewHasher(id HashID) (func() hash.Hash, error) {
+	switch id {
+	case HashMD5:
+		return md5.New, nil
+	case HashSHA256:
+		return sha256.New, nil
+	default:
+		return nil, ErrUnsupportedHash
+	}
+}
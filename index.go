@@ -0,0 +1,308 @@
+package rsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash"
+	"io"
+	"sort"
+)
+
+// indexMagic identifies a signature sidecar index file.
+const indexMagic uint32 = 0x72730349
+
+// ErrBadIndex is returned when a sidecar index file is truncated or does
+// not start with indexMagic.
+var ErrBadIndex = errors.New("rsync: bad or truncated signature index")
+
+// IndexEntry locates one signature record by its weak checksum: Offset is
+// the byte offset, within the signature stream, of that block's
+// self-contained length-prefixed record (see lpWrite/lpReadAt below).
+type IndexEntry struct {
+	WeakHash uint32
+	Offset   int64
+}
+
+// BuildIndex returns entries sorted by WeakHash, ready for WriteIndex.
+func BuildIndex(entries []IndexEntry) []IndexEntry {
+	sorted := make([]IndexEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].WeakHash < sorted[j].WeakHash })
+	return sorted
+}
+
+// indexEntrySize is the on-disk size, in bytes, of one (weak, offset) pair.
+const indexEntrySize = 4 + 8
+
+// WriteIndex writes a git-pack-.idx-style sidecar for entries (already
+// sorted by WeakHash, as returned by BuildIndex): a 256-bucket fanout
+// table keyed by the top byte of the weak checksum, followed by the
+// sorted (weak, offset) pairs themselves. A lookup need only
+// binary-search the bucket the fanout table points at, rather than the
+// full entry list.
+func WriteIndex(w io.Writer, entries []IndexEntry) error {
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.WeakHash>>24]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	if err := binary.Write(w, binary.BigEndian, indexMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(entries))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, fanout); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := binary.Write(w, binary.BigEndian, e.WeakHash); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, uint64(e.Offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index is a read-only view over a sidecar index file's bytes, typically
+// an mmap'd file, letting Lookup find candidate signature offsets for a
+// weak checksum in O(log n) time against a bounded working set instead of
+// gob-decoding every BlockHash into memory up front.
+type Index struct {
+	fanout  [256]uint32
+	entries []byte
+	count   int
+}
+
+// ReadIndex parses a sidecar index previously written by WriteIndex. data
+// is not copied, so it may be backed by an mmap'd file.
+func ReadIndex(data []byte) (*Index, error) {
+	const headerSize = 4 + 4 + 256*4
+	if len(data) < headerSize {
+		return nil, ErrBadIndex
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != indexMagic {
+		return nil, ErrBadIndex
+	}
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+	idx := &Index{count: count}
+	for i := 0; i < 256; i++ {
+		off := 8 + i*4
+		idx.fanout[i] = binary.BigEndian.Uint32(data[off : off+4])
+	}
+	start := headerSize
+	end := start + count*indexEntrySize
+	if end > len(data) {
+		return nil, ErrBadIndex
+	}
+	idx.entries = data[start:end]
+	return idx, nil
+}
+
+func (idx *Index) entry(i int) (uint32, int64) {
+	b := idx.entries[i*indexEntrySize:]
+	return binary.BigEndian.Uint32(b[0:4]), int64(binary.BigEndian.Uint64(b[4:12]))
+}
+
+// Lookup returns the signature-stream offsets of every indexed block
+// whose weak checksum equals weak.
+func (idx *Index) Lookup(weak uint32) []int64 {
+	top := weak >> 24
+	lo := 0
+	if top > 0 {
+		lo = int(idx.fanout[top-1])
+	}
+	hi := int(idx.fanout[top])
+	pos := lo + sort.Search(hi-lo, func(i int) bool {
+		w, _ := idx.entry(lo + i)
+		return w >= weak
+	})
+	var offsets []int64
+	for i := pos; i < hi; i++ {
+		w, off := idx.entry(i)
+		if w != weak {
+			break
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets
+}
+
+// lpWrite writes v as a length-prefixed, independently-decodable gob
+// value: a 4-byte big-endian length followed by that many bytes of gob
+// data with its own type descriptor. Unlike a single shared gob.Encoder
+// streamed across the whole file, this lets lpReadAt decode one record
+// without replaying everything before it.
+func lpWrite(w io.Writer, v interface{}) (int64, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(buf.Len())); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(4 + n), err
+}
+
+// lpReadAt decodes the length-prefixed record written by lpWrite at the
+// given offset into data (typically an mmap'd signature file).
+func lpReadAt(data []byte, offset int64, v interface{}) error {
+	if offset < 0 || offset+4 > int64(len(data)) {
+		return io.ErrUnexpectedEOF
+	}
+	n := binary.BigEndian.Uint32(data[offset : offset+4])
+	start := offset + 4
+	end := start + int64(n)
+	if end > int64(len(data)) {
+		return io.ErrUnexpectedEOF
+	}
+	return gob.NewDecoder(bytes.NewReader(data[start:end])).Decode(v)
+}
+
+// EncodeIndexedSignature writes the same blocks as
+// GobSigCodec.EncodeSignature, but as independent length-prefixed gob
+// records (see lpWrite) rather than one shared streamed encoder, and
+// returns the IndexEntry for each one so the caller can build a sidecar
+// Index over the result with BuildIndex/WriteIndex.
+func (GobSigCodec) EncodeIndexedSignature(w io.Writer, rs *RSync, blocks []BlockHash) ([]IndexEntry, error) {
+	var offset int64
+	n, err := lpWrite(w, gobHeader{BlockSize: rs.BlockSize, HashID: rs.HashID})
+	if err != nil {
+		return nil, err
+	}
+	offset += n
+	entries := make([]IndexEntry, 0, len(blocks))
+	for _, b := range blocks {
+		entries = append(entries, IndexEntry{WeakHash: b.WeakHash, Offset: offset})
+		n, err := lpWrite(w, b)
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+	}
+	return entries, nil
+}
+
+// DecodeIndexedBlockAt decodes a single BlockHash written by
+// EncodeIndexedSignature, using an offset obtained from an Index lookup.
+func (GobSigCodec) DecodeIndexedBlockAt(data []byte, offset int64) (BlockHash, error) {
+	var b BlockHash
+	err := lpReadAt(data, offset, &b)
+	return b, err
+}
+
+// DecodeIndexedHeader reads just the leading header record written by
+// EncodeIndexedSignature, without touching any of the block records that
+// follow it.
+func (GobSigCodec) DecodeIndexedHeader(data []byte) (*RSync, error) {
+	var header gobHeader
+	if err := lpReadAt(data, 0, &header); err != nil {
+		return nil, err
+	}
+	return &RSync{BlockSize: header.BlockSize, HashID: header.HashID}, nil
+}
+
+// CreateIndexedDelta is CreateDelta's counterpart for a signature backed
+// by a sidecar Index over mmap'd bytes rather than a fully-loaded
+// []BlockHash: instead of holding every basis block's hash in memory, it
+// looks up each window's weak checksum in idx and gob-decodes only the
+// handful of candidate records that idx.Lookup actually returns. This
+// keeps a single delta invocation's working set bounded regardless of how
+// large the basis file (and therefore its signature) is.
+func (rs *RSync) CreateIndexedDelta(newfile io.Reader, idx *Index, sigData []byte, opHandler func(op Operation) error, hasher hash.Hash) error {
+	if rs.BlockSize <= 0 {
+		return ErrInvalidBlockSize
+	}
+	newHash := rs.strongHasher()
+	h := newHash()
+
+	buf, err := io.ReadAll(newfile)
+	if err != nil {
+		return err
+	}
+	if hasher != nil {
+		hasher.Write(buf)
+	}
+
+	var literal []byte
+	flushLiteral := func() error {
+		for len(literal) > 0 {
+			n := len(literal)
+			if rs.MaxDataOp > 0 && n > rs.MaxDataOp {
+				n = rs.MaxDataOp
+			}
+			if err := opHandler(Operation{Type: DATA, Data: literal[:n]}); err != nil {
+				return err
+			}
+			literal = literal[n:]
+		}
+		return nil
+	}
+
+	// a and b are the rolling checksum's components for the window
+	// buf[i:end], valid only while rolling is true; see CreateDelta for why
+	// this matters for O(len(buf)) rather than O(len(buf)*BlockSize).
+	var a, b uint32
+	rolling := false
+
+	i := 0
+	for i < len(buf) {
+		end := i + rs.BlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		window := buf[i:end]
+		if !rolling {
+			a, b = weakChecksumAB(window)
+		}
+		weak := a | (b << 16)
+		matched := false
+		for _, offset := range idx.Lookup(weak) {
+			candidate, err := GobSigCodec{}.DecodeIndexedBlockAt(sigData, offset)
+			if err != nil {
+				return err
+			}
+			if int(candidate.Length) != len(window) {
+				continue
+			}
+			h.Reset()
+			h.Write(window)
+			if bytes.Equal(candidate.StrongHash, h.Sum(nil)) {
+				if err := flushLiteral(); err != nil {
+					return err
+				}
+				if err := opHandler(Operation{
+					Type:        BLOCK,
+					BlockIndex:  candidate.Index,
+					BlockOffset: candidate.Index * uint64(rs.BlockSize),
+					BlockLength: candidate.Length,
+				}); err != nil {
+					return err
+				}
+				matched = true
+				break
+			}
+		}
+		if matched {
+			i = end
+			rolling = false
+			continue
+		}
+		if end-i == rs.BlockSize && end < len(buf) {
+			a, b = rollChecksum(a, b, buf[i], buf[end], rs.BlockSize)
+			rolling = true
+		} else {
+			rolling = false
+		}
+		literal = append(literal, buf[i])
+		i++
+	}
+	return flushLiteral()
+}
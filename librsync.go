@@ -0,0 +1,221 @@
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// librsync .rs magic numbers, as defined by librsync's rsync.h. MD4 and
+// BLAKE2 refer to the strong hash used to disambiguate weak checksum
+// collisions in a signature; EncodeSignature picks between them based on
+// rs.HashID (see librsyncMagicForHash) rather than hardcoding one.
+const (
+	librsyncSigMagicMD4    uint32 = 0x72730136
+	librsyncSigMagicBLAKE2 uint32 = 0x72730137
+	librsyncDeltaMagic     uint32 = 0x72730236
+)
+
+// librsyncMagicForHash returns the .rs signature magic whose digest length
+// matches id's, so a real librsync peer at least frames the signature
+// correctly instead of being told BLAKE2 regardless of what hash actually
+// produced the block digests. This package has no MD4 or BLAKE2b
+// implementation (neither is in the standard library, and this package
+// vendors no external dependency), so the digest bytes themselves still
+// won't match a genuine librsync peer's - every match attempt will miss,
+// the same safe-but-slow fallback as a basis with no matching blocks at
+// all - but the header no longer lies about which hash produced them.
+func librsyncMagicForHash(id HashID) (uint32, error) {
+	switch id {
+	case HashMD5:
+		return librsyncSigMagicMD4, nil
+	case HashSHA256:
+		return librsyncSigMagicBLAKE2, nil
+	default:
+		return 0, ErrUnsupportedHash
+	}
+}
+
+// librsyncHashForMagic is librsyncMagicForHash's inverse, used by
+// DecodeSignature to recover which HashID a signature was built with.
+func librsyncHashForMagic(magic uint32) (HashID, error) {
+	switch magic {
+	case librsyncSigMagicMD4:
+		return HashMD5, nil
+	case librsyncSigMagicBLAKE2:
+		return HashSHA256, nil
+	default:
+		return 0, ErrBadMagic
+	}
+}
+
+// librsync rdiff delta command bytes. librsync specializes RS_OP_LITERAL
+// and RS_OP_COPY into several variants keyed by the byte width of their
+// length/offset (N1..N8) to keep small files compact; this codec always
+// emits the widest (N8, big-endian uint64) variant so the encode/decode
+// logic stays simple, at the cost of a few redundant zero bytes on small
+// files.
+const (
+	rsOpEnd     byte = 0x00
+	rsOpLiteral byte = 0x44 // RS_OP_LITERAL_N8
+	rsOpCopy    byte = 0x54 // RS_OP_COPY_N8_N8
+)
+
+// ErrBadMagic is returned when a stream's leading magic number does not
+// match any format this codec understands.
+var ErrBadMagic = errors.New("rsync: librsync magic mismatch")
+
+// LibrsyncSigCodec reads and writes signatures in librsync's .rs signature
+// format: magic, then big-endian block-length and strong-sum-length
+// fields, then repeated weak(4)||strong(N) records.
+type LibrsyncSigCodec struct{}
+
+func (LibrsyncSigCodec) EncodeSignature(w io.Writer, rs *RSync, blocks []BlockHash) error {
+	magic, err := librsyncMagicForHash(rs.HashID)
+	if err != nil {
+		return err
+	}
+	strongLen := uint32(0)
+	if len(blocks) > 0 {
+		strongLen = uint32(len(blocks[0].StrongHash))
+	}
+	for _, v := range []uint32{magic, uint32(rs.BlockSize), strongLen} {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	for _, b := range blocks {
+		if err := binary.Write(w, binary.BigEndian, b.WeakHash); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.StrongHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (LibrsyncSigCodec) DecodeSignature(r io.Reader) (*RSync, []BlockHash, error) {
+	var magic, blockSize, strongLen uint32
+	for _, p := range []*uint32{&magic, &blockSize, &strongLen} {
+		if err := binary.Read(r, binary.BigEndian, p); err != nil {
+			return nil, nil, err
+		}
+	}
+	hashID, err := librsyncHashForMagic(magic)
+	if err != nil {
+		return nil, nil, err
+	}
+	rs := &RSync{BlockSize: int(blockSize), HashID: hashID}
+	var blocks []BlockHash
+	var index uint64
+	for {
+		var weak uint32
+		err := binary.Read(r, binary.BigEndian, &weak)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		strong := make([]byte, strongLen)
+		if _, err := io.ReadFull(r, strong); err != nil {
+			return nil, nil, err
+		}
+		// The .rs format records no per-block length, so every block,
+		// including a shorter final one, is given the header block length.
+		length := uint32(blockSize)
+		blocks = append(blocks, BlockHash{Index: index, WeakHash: weak, StrongHash: strong, Length: length})
+		index++
+	}
+	return rs, blocks, nil
+}
+
+// LibrsyncDeltaCodec reads and writes deltas in librsync's rdiff command
+// format: magic, then a sequence of RS_OP_* command bytes, terminated by
+// RS_OP_END. LITERAL carries its data inline; COPY addresses the basis
+// file directly by byte offset and length, so it round-trips through
+// Operation.BlockOffset/BlockLength rather than BlockIndex. librsync has no
+// wire representation for a whole-file checksum, so sourceSum is dropped
+// on encode and always nil on decode. It likewise has no representation
+// for a MAC operation: EncodeDelta rejects one with ErrUnknownOperation,
+// so -hmac-key-file requires -format=gob.
+type LibrsyncDeltaCodec struct{}
+
+func (LibrsyncDeltaCodec) EncodeDelta(w io.Writer, rs *RSync, ops []Operation, sourceSum []byte) error {
+	if err := binary.Write(w, binary.BigEndian, librsyncDeltaMagic); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case DATA:
+			if _, err := w.Write([]byte{rsOpLiteral}); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.BigEndian, uint64(len(op.Data))); err != nil {
+				return err
+			}
+			if _, err := w.Write(op.Data); err != nil {
+				return err
+			}
+		case BLOCK:
+			if _, err := w.Write([]byte{rsOpCopy}); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.BigEndian, op.BlockOffset); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.BigEndian, uint64(op.BlockLength)); err != nil {
+				return err
+			}
+		default:
+			return ErrUnknownOperation
+		}
+	}
+	_, err := w.Write([]byte{rsOpEnd})
+	return err
+}
+
+func (LibrsyncDeltaCodec) DecodeDelta(r io.Reader) (*RSync, []Operation, []byte, []byte, error) {
+	br := bufio.NewReader(r)
+	var magic uint32
+	if err := binary.Read(br, binary.BigEndian, &magic); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if magic != librsyncDeltaMagic {
+		return nil, nil, nil, nil, ErrBadMagic
+	}
+	var ops []Operation
+	for {
+		cmd, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		switch cmd {
+		case rsOpEnd:
+			return &RSync{}, ops, nil, nil, nil
+		case rsOpLiteral:
+			var n uint64
+			if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			ops = append(ops, Operation{Type: DATA, Data: data})
+		case rsOpCopy:
+			var offset, length uint64
+			if err := binary.Read(br, binary.BigEndian, &offset); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			ops = append(ops, Operation{Type: BLOCK, BlockOffset: offset, BlockLength: uint32(length)})
+		default:
+			return nil, nil, nil, nil, ErrUnknownOperation
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package rsync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/gob"
+	"errors"
+	"hash"
+)
+
+// ErrMACMismatch is returned when a delta's MAC operation does not match the
+// MAC recomputed over the rest of the stream, meaning the delta was altered
+// (or built with a different key/algorithm) after it was produced.
+var ErrMACMismatch = errors.New("rsync: delta MAC does not match; stream may have been tampered with")
+
+// ErrNoMAC is returned when authenticated verification is requested but the
+// delta carries no trailing Operation{Type: MAC}.
+var ErrNoMAC = errors.New("rsync: authenticated patch requested but delta carries no MAC operation")
+
+// NewMAC builds a keyed HMAC using the strong hash identified by id as its
+// underlying hash function.
+func NewMAC(id HashID, key []byte) (hash.Hash, error) {
+	newHash, err := NewHasher(id)
+	if err != nil {
+		return nil, err
+	}
+	return hmac.New(newHash, key), nil
+}
+
+// WriteOpToMAC feeds one delta Operation's canonical gob encoding into mac,
+// so that a producer and a verifier agree byte-for-byte on what the MAC
+// covers regardless of the wire format the operation is eventually written
+// in.
+func WriteOpToMAC(mac hash.Hash, op Operation) error {
+	return gob.NewEncoder(mac).Encode(op)
+}
+
+// VerifyDeltaMAC recomputes the MAC over ops (the delta's BLOCK/DATA
+// operations, in order) using hashID and key, and compares it against want,
+// the Data of the delta's trailing Operation{Type: MAC}. It must be called,
+// and must succeed, before any of ops is handed to ApplyDelta for an
+// untrusted delta.
+func VerifyDeltaMAC(ops []Operation, hashID HashID, key []byte, want []byte) error {
+	if want == nil {
+		return ErrNoMAC
+	}
+	mac, err := NewMAC(hashID, key)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := WriteOpToMAC(mac, op); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(mac.Sum(nil), want) {
+		return ErrMACMismatch
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package rsync
+
+import (
+	"io"
+	"os"
+)
+
+// MmapFile falls back to a plain read on Windows, where this package does
+// not use syscall.Mmap; Index lookups over the result work the same, but
+// the whole file is held in memory.
+func MmapFile(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(f)
+}
+
+// MunmapFile is a no-op here since MmapFile did a regular read.
+func MunmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package rsync
+
+import (
+	"os"
+	"syscall"
+)
+
+// MmapFile maps f's full contents read-only. The returned slice must be
+// released with MunmapFile once the caller is done with it.
+func MmapFile(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// MunmapFile releases a mapping returned by MmapFile.
+func MunmapFile(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
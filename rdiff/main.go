@@ -8,7 +8,6 @@ import (
 	"bitbucket.org/kardianos/rsync"
 
 	"bytes"
-	"crypto/md5"
 	"encoding/gob"
 	"errors"
 	"flag"
@@ -28,6 +27,20 @@ var fl = flag.NewFlagSet("rdiff", flag.ContinueOnError)
 var blockSizeKiB = fl.Int("block", 6, "Block size in KiB")
 var checkFile = fl.Bool("check", true, "Verify file with checksum")
 
+var cdc = fl.Bool("cdc", false, "Use content-defined chunking instead of fixed-size blocks")
+var cdcAvg = fl.Int("cdc-avg", 8*1024, "Target average chunk size in bytes for -cdc")
+var cdcMin = fl.Int("cdc-min", 0, "Minimum chunk size in bytes for -cdc (default cdc-avg/4)")
+var cdcMax = fl.Int("cdc-max", 0, "Maximum chunk size in bytes for -cdc (default cdc-avg*8)")
+
+var format = fl.String("format", "gob", "Signature/delta wire format: gob (this tool's native format) or librsync (interop with librsync's .rs files)")
+
+var withIndex = fl.Bool("index", false, "Also write/consult a SIGNATURE.idx sidecar for random access into large signatures (gob format only)")
+
+var hashName = fl.String("hash", "md5", "Strong hash used to disambiguate weak checksum collisions: md5 or sha256")
+var hmacKeyFile = fl.String("hmac-key-file", "", "Authenticate the delta with an HMAC keyed from this file's contents, appended as a MAC operation and verified by patch before committing any output (gob format only)")
+
+var compress = fl.String("compress", "none", "Compress the signature/delta file written by signature/delta: none or gzip. patch and delta auto-detect the codec from the file itself (gob format only, incompatible with -index)")
+
 func main() {
 	var err error
 	err = fl.Parse(os.Args[1:])
@@ -58,6 +71,12 @@ func main() {
 		err = patch(fl.Arg(1), fl.Arg(2), fl.Arg(3))
 	case "test":
 		err = test(fl.Arg(1), fl.Arg(2))
+	case "signature-tree":
+		err = signatureTree(fl.Arg(1), fl.Arg(2))
+	case "delta-tree":
+		err = deltaTree(fl.Arg(1), fl.Arg(2), fl.Arg(3))
+	case "patch-tree":
+		err = patchTree(fl.Arg(1), fl.Arg(2), fl.Arg(3))
 	default:
 		log.Printf("Error: Unrecognized verb: %s", verb)
 		printHelp()
@@ -74,7 +93,10 @@ func printHelp() {
 %s [options] delta SIGNATURE NEWFILE DELTA
 %s [options] patch BASIS DELTA NEWFILE
 %s [options] test BASIS BASISv2
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+%s [options] signature-tree BASISDIR ARCHIVE
+%s [options] delta-tree ARCHIVE NEWDIR DELTA
+%s [options] patch-tree BASISDIR DELTA NEWDIR
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	fl.PrintDefaults()
 }
 
@@ -85,8 +107,116 @@ func getRsync() *rsync.RSync {
 	}
 }
 
+func getCDCConfig() rsync.CDCConfig {
+	return rsync.CDCConfig{
+		Average: *cdcAvg,
+		Min:     *cdcMin,
+		Max:     *cdcMax,
+	}
+}
+
+func parseHashID(name string) (rsync.HashID, error) {
+	switch name {
+	case "md5":
+		return rsync.HashMD5, nil
+	case "sha256":
+		return rsync.HashSHA256, nil
+	default:
+		return 0, fmt.Errorf("unrecognized -hash: %s", name)
+	}
+}
+
+// applyHashID resolves -hash into rs.HashID and rs.UniqueHasher, so that
+// signature uses it to build blocks and delta/patch can instead be pointed
+// at whatever HashID a decoded header actually carries.
+func applyHashID(rs *rsync.RSync, id rsync.HashID) error {
+	newHash, err := rsync.NewHasher(id)
+	if err != nil {
+		return err
+	}
+	rs.HashID = id
+	rs.UniqueHasher = newHash
+	return nil
+}
+
+// hmacKey reads the key for -hmac-key-file, returning nil if the flag was
+// not given.
+func hmacKey() ([]byte, error) {
+	if *hmacKeyFile == "" {
+		return nil, nil
+	}
+	return os.ReadFile(*hmacKeyFile)
+}
+
+func parseCompressID(name string) (rsync.CompressionID, error) {
+	switch name {
+	case "none":
+		return rsync.CompressNone, nil
+	case "gzip":
+		return rsync.CompressGzip, nil
+	default:
+		return 0, fmt.Errorf("unrecognized -compress: %s", name)
+	}
+}
+
+// sigHeader is the first value gob-encoded into a -cdc signature (and
+// echoed into the matching delta), recording enough to decode the rest of
+// the stream without the caller having to pass flags back in. Fixed-block
+// signatures/deltas carry no CDC-specific state, so they go through a
+// rsync.SigCodec/rsync.DeltaCodec instead; content-defined chunking has no
+// representation in the librsync wire format, so it always uses this gob
+// encoding regardless of -format.
+type sigHeader struct {
+	BlockSize int
+	CDCConfig rsync.CDCConfig
+	HashID    rsync.HashID
+}
+
+func sigCodec() (rsync.SigCodec, error) {
+	switch *format {
+	case "gob":
+		return rsync.GobSigCodec{}, nil
+	case "librsync":
+		return rsync.LibrsyncSigCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized -format: %s", *format)
+	}
+}
+
+func deltaCodec() (rsync.DeltaCodec, error) {
+	switch *format {
+	case "gob":
+		return rsync.GobDeltaCodec{}, nil
+	case "librsync":
+		return rsync.LibrsyncDeltaCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized -format: %s", *format)
+	}
+}
+
 func signature(basis, signature string) error {
 	rs := getRsync()
+	hashID, err := parseHashID(*hashName)
+	if err != nil {
+		return err
+	}
+	if err := applyHashID(rs, hashID); err != nil {
+		return err
+	}
+	compressID, err := parseCompressID(*compress)
+	if err != nil {
+		return err
+	}
+	if *withIndex && compressID != rsync.CompressNone {
+		return fmt.Errorf("-compress is incompatible with -index")
+	}
+	if compressID != rsync.CompressNone && !*cdc && *format != "gob" {
+		return fmt.Errorf("-compress requires -format=gob")
+	}
+	if *cdc && *withIndex {
+		return fmt.Errorf("-index requires non-cdc mode")
+	}
+
 	basisFile, err := os.Open(basis)
 	if err != nil {
 		return err
@@ -99,19 +229,87 @@ func signature(basis, signature string) error {
 	}
 	defer sigFile.Close()
 
-	sigEncode := gob.NewEncoder(sigFile)
-	err = sigEncode.Encode(rs.BlockSize)
+	if *cdc {
+		sigWriter, err := rsync.NewCompressWriter(sigFile, compressID)
+		if err != nil {
+			return err
+		}
+		defer sigWriter.Close()
+		sigEncode := gob.NewEncoder(sigWriter)
+		header := sigHeader{BlockSize: rs.BlockSize, CDCConfig: getCDCConfig(), HashID: rs.HashID}
+		if err := sigEncode.Encode(header); err != nil {
+			return err
+		}
+		return rs.CreateCDCSignature(basisFile, header.CDCConfig, func(chunk rsync.ChunkHash) error {
+			// Save signature chunk list to file.
+			return sigEncode.Encode(chunk)
+		})
+	}
+
+	var blocks []rsync.BlockHash
+	if err := rs.CreateSignature(basisFile, func(block rsync.BlockHash) error {
+		blocks = append(blocks, block)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if *withIndex {
+		if *format != "gob" {
+			return fmt.Errorf("-index requires -format=gob")
+		}
+		entries, err := rsync.GobSigCodec{}.EncodeIndexedSignature(sigFile, rs, blocks)
+		if err != nil {
+			return err
+		}
+		idxFile, err := os.Create(signature + ".idx")
+		if err != nil {
+			return err
+		}
+		defer idxFile.Close()
+		return rsync.WriteIndex(idxFile, rsync.BuildIndex(entries))
+	}
+
+	var sigWriter io.Writer = sigFile
+	if *format == "gob" {
+		w, err := rsync.NewCompressWriter(sigFile, compressID)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		sigWriter = w
+	}
+
+	codec, err := sigCodec()
 	if err != nil {
 		return err
 	}
-	return rs.CreateSignature(basisFile, func(block rsync.BlockHash) error {
-		// Save signature hash list to file.
-		return sigEncode.Encode(block)
-	})
+	return codec.EncodeSignature(sigWriter, rs, blocks)
 }
 
 func delta(signature, newfile, delta string) error {
 	rs := getRsync()
+	key, err := hmacKey()
+	if err != nil {
+		return err
+	}
+	if key != nil && *format != "gob" {
+		return fmt.Errorf("-hmac-key-file requires -format=gob")
+	}
+	compressID, err := parseCompressID(*compress)
+	if err != nil {
+		return err
+	}
+	if *withIndex && compressID != rsync.CompressNone {
+		return fmt.Errorf("-compress is incompatible with -index")
+	}
+	if compressID != rsync.CompressNone && !*cdc && *format != "gob" {
+		return fmt.Errorf("-compress requires -format=gob")
+	}
+	if *cdc && *withIndex {
+		return fmt.Errorf("-index requires non-cdc mode")
+	}
+
 	sigFile, err := os.Open(signature)
 	if err != nil {
 		return err
@@ -130,56 +328,211 @@ func delta(signature, newfile, delta string) error {
 	}
 	defer deltaFile.Close()
 
-	// Load signature hash list.
-	hl := make([]rsync.BlockHash, 0)
-	sigDecode := gob.NewDecoder(sigFile)
-	err = sigDecode.Decode(&rs.BlockSize)
-	if err != nil {
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
+	if *cdc {
+		sigReader, err := rsync.NewCompressReader(sigFile)
+		if err != nil {
+			return err
 		}
-		return err
+		defer sigReader.Close()
+
+		// Load the signature header, then its chunk list.
+		var header sigHeader
+		sigDecode := gob.NewDecoder(sigReader)
+		if err := sigDecode.Decode(&header); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		rs.BlockSize = header.BlockSize
+		if err := applyHashID(rs, header.HashID); err != nil {
+			return err
+		}
+
+		cl := make([]rsync.ChunkHash, 0)
+		for {
+			ch := rsync.ChunkHash{}
+			err := sigDecode.Decode(&ch)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			cl = append(cl, ch)
+		}
+
+		var hasher hash.Hash
+		if *checkFile {
+			hasher = rs.UniqueHasher()
+		}
+		var mac hash.Hash
+		if key != nil {
+			mac, err = rsync.NewMAC(rs.HashID, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		deltaWriter, err := rsync.NewCompressWriter(deltaFile, compressID)
+		if err != nil {
+			return err
+		}
+		defer deltaWriter.Close()
+
+		// Save operations to file, echoing the same header so patch
+		// knows how to interpret the BLOCK operations below.
+		opsEncode := gob.NewEncoder(deltaWriter)
+		if err := opsEncode.Encode(header); err != nil {
+			return err
+		}
+		opHandler := func(op rsync.Operation) error {
+			if mac != nil {
+				if err := rsync.WriteOpToMAC(mac, op); err != nil {
+					return err
+				}
+			}
+			return opsEncode.Encode(op)
+		}
+		if err := rs.CreateCDCDelta(nfFile, cl, header.CDCConfig, opHandler, hasher); err != nil {
+			return err
+		}
+		if *checkFile {
+			if err := opsEncode.Encode(rsync.Operation{Type: rsync.HASH, Data: hasher.Sum(nil)}); err != nil {
+				return err
+			}
+		}
+		if mac != nil {
+			return opsEncode.Encode(rsync.Operation{Type: rsync.MAC, Data: mac.Sum(nil)})
+		}
+		return nil
 	}
-	for {
-		bl := rsync.BlockHash{}
-		err = sigDecode.Decode(&bl)
-		if err == io.EOF {
-			break
+
+	opCollector := func(ops *[]rsync.Operation) func(rsync.Operation) error {
+		return func(op rsync.Operation) error {
+			*ops = append(*ops, op)
+			return nil
 		}
+	}
+
+	var ops []rsync.Operation
+	var sourceSum []byte
+	if *withIndex {
+		if *format != "gob" {
+			return fmt.Errorf("-index requires -format=gob")
+		}
+		idxFile, err := os.Open(signature + ".idx")
+		if err != nil {
+			return err
+		}
+		defer idxFile.Close()
+		idxData, err := rsync.MmapFile(idxFile)
+		if err != nil {
+			return err
+		}
+		defer rsync.MunmapFile(idxData)
+		idx, err := rsync.ReadIndex(idxData)
 		if err != nil {
 			return err
 		}
-		hl = append(hl, bl)
+		sigData, err := rsync.MmapFile(sigFile)
+		if err != nil {
+			return err
+		}
+		defer rsync.MunmapFile(sigData)
+		decodedRS, err := rsync.GobSigCodec{}.DecodeIndexedHeader(sigData)
+		if err != nil {
+			return err
+		}
+		rs.BlockSize = decodedRS.BlockSize
+		if err := applyHashID(rs, decodedRS.HashID); err != nil {
+			return err
+		}
+		var hasher hash.Hash
+		if *checkFile {
+			hasher = rs.UniqueHasher()
+		}
+		if err := rs.CreateIndexedDelta(nfFile, idx, sigData, opCollector(&ops), hasher); err != nil {
+			return err
+		}
+		if *checkFile {
+			sourceSum = hasher.Sum(nil)
+		}
+	} else {
+		var sigReader io.Reader = sigFile
+		if *format == "gob" {
+			r, err := rsync.NewCompressReader(sigFile)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			sigReader = r
+		}
+
+		sCodec, err := sigCodec()
+		if err != nil {
+			return err
+		}
+		decodedRS, hl, err := sCodec.DecodeSignature(sigReader)
+		if err != nil {
+			return err
+		}
+		rs.BlockSize = decodedRS.BlockSize
+		if err := applyHashID(rs, decodedRS.HashID); err != nil {
+			return err
+		}
+		var hasher hash.Hash
+		if *checkFile {
+			hasher = rs.UniqueHasher()
+		}
+		if err := rs.CreateDelta(nfFile, hl, opCollector(&ops), hasher); err != nil {
+			return err
+		}
+		if *checkFile {
+			sourceSum = hasher.Sum(nil)
+		}
 	}
 
-	// Save operations to file.
-	opsEncode := gob.NewEncoder(deltaFile)
-	err = opsEncode.Encode(rs.BlockSize)
-	if err != nil {
-		return err
+	if key != nil {
+		mac, err := rsync.NewMAC(rs.HashID, key)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			if err := rsync.WriteOpToMAC(mac, op); err != nil {
+				return err
+			}
+		}
+		ops = append(ops, rsync.Operation{Type: rsync.MAC, Data: mac.Sum(nil)})
 	}
 
-	var hasher hash.Hash
-	if *checkFile {
-		hasher = md5.New()
+	var deltaWriter io.Writer = deltaFile
+	if *format == "gob" {
+		w, err := rsync.NewCompressWriter(deltaFile, compressID)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		deltaWriter = w
 	}
-	err = rs.CreateDelta(nfFile, hl, func(op rsync.Operation) error {
-		return opsEncode.Encode(op)
-	}, hasher)
+
+	dCodec, err := deltaCodec()
 	if err != nil {
 		return err
 	}
-	if *checkFile {
-		return opsEncode.Encode(rsync.Operation{
-			Type: rsync.HASH,
-			Data: hasher.Sum(nil),
-		})
-	}
-	return nil
+	return dCodec.EncodeDelta(deltaWriter, rs, ops, sourceSum)
 }
 
 func patch(basis, delta, newfile string) error {
 	rs := getRsync()
+	key, err := hmacKey()
+	if err != nil {
+		return err
+	}
+	if key != nil && *format != "gob" {
+		return fmt.Errorf("-hmac-key-file requires -format=gob")
+	}
+
 	basisFile, err := os.Open(basis)
 	if err != nil {
 		return err
@@ -199,52 +552,104 @@ func patch(basis, delta, newfile string) error {
 	defer fsFile.Close()
 
 	var sourceSum []byte
-	deltaDecode := gob.NewDecoder(deltaFile)
-	err = deltaDecode.Decode(&rs.BlockSize)
-	if err != nil {
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
+	var mac []byte
+	var decodedOps []rsync.Operation
+	if *cdc {
+		deltaReader, err := rsync.NewCompressReader(deltaFile)
+		if err != nil {
+			return err
 		}
-		return err
-	}
+		defer deltaReader.Close()
 
-	ops := make(chan rsync.Operation)
-	// Load operations from file.
-	var decodeError error
-	go func() {
-		defer close(ops)
+		var header sigHeader
+		deltaDecode := gob.NewDecoder(deltaReader)
+		if err := deltaDecode.Decode(&header); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		rs.BlockSize = header.BlockSize
+		if err := applyHashID(rs, header.HashID); err != nil {
+			return err
+		}
 		for {
 			op := rsync.Operation{}
-			err = deltaDecode.Decode(&op)
+			err := deltaDecode.Decode(&op)
 			if err == io.EOF {
 				break
 			}
 			if err != nil {
-				decodeError = err
-				return
+				return err
 			}
 			if op.Type == rsync.HASH {
 				sourceSum = op.Data
 				continue
 			}
+			if op.Type == rsync.MAC {
+				mac = op.Data
+				continue
+			}
+			decodedOps = append(decodedOps, op)
+		}
+	} else {
+		var deltaReader io.Reader = deltaFile
+		if *format == "gob" {
+			r, err := rsync.NewCompressReader(deltaFile)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			deltaReader = r
+		}
+
+		dCodec, err := deltaCodec()
+		if err != nil {
+			return err
+		}
+		decodedRS, ops, sum, opMAC, err := dCodec.DecodeDelta(deltaReader)
+		if err != nil {
+			return err
+		}
+		rs.BlockSize = decodedRS.BlockSize
+		if err := applyHashID(rs, decodedRS.HashID); err != nil {
+			return err
+		}
+		decodedOps = ops
+		sourceSum = sum
+		mac = opMAC
+	}
+
+	if key != nil {
+		if err := rsync.VerifyDeltaMAC(decodedOps, rs.HashID, key, mac); err != nil {
+			return err
+		}
+	}
+
+	ops := make(chan rsync.Operation)
+	go func() {
+		defer close(ops)
+		for _, op := range decodedOps {
 			ops <- op
 		}
 	}()
 
 	var hasher hash.Hash
 	if *checkFile {
-		hasher = md5.New()
+		hasher = rs.UniqueHasher()
 	}
 	err = rs.ApplyDelta(fsFile, basisFile, ops, hasher)
 	if err != nil {
 		return err
 	}
-	if decodeError != nil {
-		return decodeError
-	}
 	if *checkFile == false {
 		return nil
 	}
+	if !*cdc && *format == "librsync" {
+		// librsync's delta format carries no whole-file checksum to
+		// verify against; -check only applies to our native gob format.
+		return nil
+	}
 	if sourceSum == nil {
 		return NoTargetSumError
 	}
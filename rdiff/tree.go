@@ -0,0 +1,481 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"bitbucket.org/kardianos/rsync"
+)
+
+var jobs = fl.Int("jobs", 1, "Number of files to process concurrently for *-tree verbs")
+
+// treeEntryKind distinguishes the filesystem object a treeEntry describes,
+// since a manifest has to reconstruct directories and symlinks as well as
+// regular files.
+type treeEntryKind byte
+
+const (
+	entryFile treeEntryKind = iota
+	entryDir
+	entrySymlink
+)
+
+// treeEntry is one manifest record: enough to recreate a path's mode,
+// symlink target, or (for a regular file) to tell whether its content
+// changed between basis and new trees.
+type treeEntry struct {
+	Path       string
+	Kind       treeEntryKind
+	Mode       os.FileMode
+	LinkTarget string
+	Hash       []byte // whole-file strong hash; regular files only
+}
+
+// sigManifest is the MANIFEST record of a signature-tree archive.
+type sigManifest struct {
+	BlockSize int
+	Entries   []treeEntry
+}
+
+// deltaManifest is the MANIFEST record of a delta-tree archive. Reused
+// marks a regular file whose content hash matched the basis tree, so
+// patch-tree can copy it straight from the basis tree instead of running
+// ApplyDelta.
+type deltaManifest struct {
+	Entries []deltaManifestEntry
+}
+
+// deltaManifestEntry names its treeEntry field rather than embedding it:
+// gob only promotes fields through an *exported* anonymous field name, and
+// treeEntry is unexported, so an embedded field would decode as entirely
+// zeroed.
+type deltaManifestEntry struct {
+	Entry  treeEntry
+	Reused bool
+}
+
+const manifestName = "MANIFEST"
+
+// sigEntryName and deltaEntryName name the tar entry holding a given
+// path's per-file signature or delta payload within a tree archive.
+func sigEntryName(path string) string   { return "sig/" + path }
+func deltaEntryName(path string) string { return "delta/" + path }
+
+// runPool runs tasks with up to n of them in flight at once, fanning work
+// out over a channel the way test's buffer pool fans reads out to a fixed
+// set of goroutines, and returns the first error encountered (if any)
+// only after every task has finished.
+func runPool(n int, tasks []func() error) error {
+	if n <= 0 {
+		n = 1
+	}
+	taskCh := make(chan func() error)
+	errCh := make(chan error, len(tasks))
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range taskCh {
+				errCh <- t()
+			}
+		}()
+	}
+
+	go func() {
+		for _, t := range tasks {
+			taskCh <- t
+		}
+		close(taskCh)
+	}()
+
+	wg.Wait()
+	close(errCh)
+
+	var firstErr error
+	for err := range errCh {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// walkTree lists dirRoot's entries in a stable order, relative to
+// dirRoot, for both signature-tree and delta-tree to iterate over.
+func walkTree(dirRoot string) ([]treeEntry, error) {
+	var entries []treeEntry
+	err := filepath.Walk(dirRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dirRoot, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, treeEntry{Path: rel, Kind: entrySymlink, Mode: info.Mode(), LinkTarget: target})
+		case info.IsDir():
+			entries = append(entries, treeEntry{Path: rel, Kind: entryDir, Mode: info.Mode()})
+		default:
+			hash, err := fileHash(p)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, treeEntry{Path: rel, Kind: entryFile, Mode: info.Mode(), Hash: hash})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func signatureTree(basisDir, archive string) error {
+	entries, err := walkTree(basisDir)
+	if err != nil {
+		return err
+	}
+
+	archiveFile, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+	tw := tar.NewWriter(archiveFile)
+	defer tw.Close()
+
+	var manifest bytes.Buffer
+	if err := gob.NewEncoder(&manifest).Encode(sigManifest{BlockSize: getRsync().BlockSize, Entries: entries}); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: manifestName, Size: int64(manifest.Len()), Mode: 0644}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest.Bytes()); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	tasks := make([]func() error, 0, len(entries))
+	for _, e := range entries {
+		if e.Kind != entryFile {
+			continue
+		}
+		e := e
+		tasks = append(tasks, func() error {
+			rs := getRsync()
+			f, err := os.Open(filepath.Join(basisDir, e.Path))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			var blocks []rsync.BlockHash
+			if err := rs.CreateSignature(f, func(b rsync.BlockHash) error {
+				blocks = append(blocks, b)
+				return nil
+			}); err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := (rsync.GobSigCodec{}).EncodeSignature(&buf, rs, blocks); err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err := tw.WriteHeader(&tar.Header{Name: sigEntryName(e.Path), Size: int64(buf.Len()), Mode: 0644}); err != nil {
+				return err
+			}
+			_, err = tw.Write(buf.Bytes())
+			return err
+		})
+	}
+	return runPool(*jobs, tasks)
+}
+
+// readTarByName reads r, which must be positioned at the start of a tar
+// stream, up to the first entry named name and returns that entry's
+// contents.
+func readTarByName(r io.Reader, name string) ([]byte, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("tree archive missing %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+func deltaTree(sigArchive, newDir, deltaArchive string) error {
+	sigFile, err := os.Open(sigArchive)
+	if err != nil {
+		return err
+	}
+	defer sigFile.Close()
+
+	manifestBytes, err := readTarByName(sigFile, manifestName)
+	if err != nil {
+		return err
+	}
+	var basis sigManifest
+	if err := gob.NewDecoder(bytes.NewReader(manifestBytes)).Decode(&basis); err != nil {
+		return err
+	}
+	basisByPath := make(map[string]treeEntry, len(basis.Entries))
+	for _, e := range basis.Entries {
+		basisByPath[e.Path] = e
+	}
+
+	newEntries, err := walkTree(newDir)
+	if err != nil {
+		return err
+	}
+
+	deltaArchiveFile, err := os.Create(deltaArchive)
+	if err != nil {
+		return err
+	}
+	defer deltaArchiveFile.Close()
+	tw := tar.NewWriter(deltaArchiveFile)
+	defer tw.Close()
+
+	deltaEntries := make([]deltaManifestEntry, len(newEntries))
+	for i, e := range newEntries {
+		reused := false
+		if e.Kind == entryFile {
+			if old, ok := basisByPath[e.Path]; ok && old.Kind == entryFile && bytes.Equal(old.Hash, e.Hash) {
+				reused = true
+			}
+		}
+		deltaEntries[i] = deltaManifestEntry{Entry: e, Reused: reused}
+	}
+
+	var mu sync.Mutex
+	tasks := make([]func() error, 0, len(newEntries))
+	for i, e := range newEntries {
+		if e.Kind != entryFile || deltaEntries[i].Reused {
+			continue
+		}
+		e := e
+		tasks = append(tasks, func() error {
+			// Re-open the signature archive per task: archive/tar
+			// readers aren't safe to share across goroutines.
+			sf, err := os.Open(sigArchive)
+			if err != nil {
+				return err
+			}
+			defer sf.Close()
+			sigBytes, err := readTarByName(sf, sigEntryName(e.Path))
+			if err != nil {
+				// New file with no basis counterpart: delta against
+				// an empty block list, i.e. all-literal.
+				sigBytes = nil
+			}
+
+			rs := getRsync()
+			var hl []rsync.BlockHash
+			if sigBytes != nil {
+				decodedRS, blocks, err := (rsync.GobSigCodec{}).DecodeSignature(bytes.NewReader(sigBytes))
+				if err != nil {
+					return err
+				}
+				rs.BlockSize = decodedRS.BlockSize
+				hl = blocks
+			}
+
+			nf, err := os.Open(filepath.Join(newDir, e.Path))
+			if err != nil {
+				return err
+			}
+			defer nf.Close()
+
+			var ops []rsync.Operation
+			if err := rs.CreateDelta(nf, hl, func(op rsync.Operation) error {
+				ops = append(ops, op)
+				return nil
+			}, nil); err != nil {
+				return err
+			}
+
+			var buf bytes.Buffer
+			if err := (rsync.GobDeltaCodec{}).EncodeDelta(&buf, rs, ops, nil); err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err := tw.WriteHeader(&tar.Header{Name: deltaEntryName(e.Path), Size: int64(buf.Len()), Mode: 0644}); err != nil {
+				return err
+			}
+			_, err = tw.Write(buf.Bytes())
+			return err
+		})
+	}
+	if err := runPool(*jobs, tasks); err != nil {
+		return err
+	}
+
+	var manifest bytes.Buffer
+	if err := gob.NewEncoder(&manifest).Encode(deltaManifest{Entries: deltaEntries}); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: manifestName, Size: int64(manifest.Len()), Mode: 0644}); err != nil {
+		return err
+	}
+	_, err = tw.Write(manifest.Bytes())
+	return err
+}
+
+func patchTree(basisDir, deltaArchive, newDir string) error {
+	deltaFile, err := os.Open(deltaArchive)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	manifestBytes, err := readTarByName(deltaFile, manifestName)
+	if err != nil {
+		return err
+	}
+	var manifest deltaManifest
+	if err := gob.NewDecoder(bytes.NewReader(manifestBytes)).Decode(&manifest); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		return err
+	}
+
+	// Directories and symlinks are cheap and order-sensitive (a file's
+	// parent directory must exist first), so create them up front,
+	// single-threaded, before fanning the file content out to workers.
+	for _, e := range manifest.Entries {
+		target := filepath.Join(newDir, e.Entry.Path)
+		switch e.Entry.Kind {
+		case entryDir:
+			if err := os.MkdirAll(target, e.Entry.Mode.Perm()); err != nil {
+				return err
+			}
+		case entrySymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(e.Entry.LinkTarget, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	tasks := make([]func() error, 0, len(manifest.Entries))
+	for _, e := range manifest.Entries {
+		if e.Entry.Kind != entryFile {
+			continue
+		}
+		e := e
+		tasks = append(tasks, func() error {
+			target := filepath.Join(newDir, e.Entry.Path)
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if e.Reused {
+				return copyFile(filepath.Join(basisDir, e.Entry.Path), target, e.Entry.Mode.Perm())
+			}
+
+			df, err := os.Open(deltaArchive)
+			if err != nil {
+				return err
+			}
+			defer df.Close()
+			opBytes, err := readTarByName(df, deltaEntryName(e.Entry.Path))
+			if err != nil {
+				return err
+			}
+			rs := getRsync()
+			decodedRS, ops, _, _, err := (rsync.GobDeltaCodec{}).DecodeDelta(bytes.NewReader(opBytes))
+			if err != nil {
+				return err
+			}
+			rs.BlockSize = decodedRS.BlockSize
+
+			// A file added since the basis was signed has no basis
+			// counterpart on disk at all; deltaTree already diffed it
+			// against an empty block list (all-literal), so ApplyDelta
+			// never needs to read from basis in that case.
+			var basis io.ReaderAt = bytes.NewReader(nil)
+			basisFile, err := os.Open(filepath.Join(basisDir, e.Entry.Path))
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return err
+				}
+			} else {
+				defer basisFile.Close()
+				basis = basisFile
+			}
+
+			outFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, e.Entry.Mode.Perm())
+			if err != nil {
+				return err
+			}
+			defer outFile.Close()
+
+			opCh := make(chan rsync.Operation)
+			go func() {
+				defer close(opCh)
+				for _, op := range ops {
+					opCh <- op
+				}
+			}()
+			return rs.ApplyDelta(outFile, basis, opCh, nil)
+		})
+	}
+	return runPool(*jobs, tasks)
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,295 @@
+// Package rsync implements the rsync rolling-checksum algorithm for
+// generating signatures of a basis file, diffing a new file against that
+// signature, and reconstructing the new file from the basis plus the
+// resulting delta.
+package rsync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"hash"
+	"io"
+)
+
+var ErrInvalidBlockSize = errors.New("rsync: invalid block size")
+var ErrUnknownOperation = errors.New("rsync: unknown operation type")
+
+// OpType identifies the kind of a single delta Operation.
+type OpType byte
+
+const (
+	// BLOCK references a single unchanged block from the basis file.
+	BLOCK OpType = iota
+	// BLOCKRANGE references a contiguous run of unchanged basis blocks.
+	BLOCKRANGE
+	// DATA carries literal bytes that did not match any basis block.
+	DATA
+	// HASH carries the whole-file strong checksum of the reconstructed
+	// file, used by callers that want to verify the patch result.
+	HASH
+	// MAC carries a keyed MAC (see NewMAC) of the delta's BLOCK and DATA
+	// operations, letting VerifyDeltaMAC detect a tampered delta before
+	// any of it is written to the reconstructed file.
+	MAC
+)
+
+// Operation is a single step of a delta stream: either "copy these basis
+// blocks" or "write this literal data".
+type Operation struct {
+	Type          OpType
+	BlockIndex    uint64
+	BlockIndexEnd uint64
+	Data          []byte
+
+	// BlockOffset and BlockLength describe a BLOCK operation's extent in
+	// the basis file directly, for variable-length (e.g. CDC) chunks
+	// where BlockIndex*BlockSize does not locate the data. CreateDelta
+	// fills them in for fixed-size blocks too; when BlockLength is zero,
+	// ApplyDelta derives the extent from BlockIndex and RSync.BlockSize
+	// instead.
+	BlockOffset uint64
+	BlockLength uint32
+}
+
+// BlockHash is the weak and strong checksum pair for one basis block, as
+// recorded in a signature. Length is the actual number of bytes hashed,
+// which is less than RSync.BlockSize for a file's final block.
+type BlockHash struct {
+	Index      uint64
+	StrongHash []byte
+	WeakHash   uint32
+	Length     uint32
+}
+
+// RSync holds the parameters used by the signature/delta/patch operations.
+// The zero value is not usable; construct one with the desired BlockSize.
+type RSync struct {
+	// BlockSize is the size, in bytes, of each basis block hashed into
+	// the signature.
+	BlockSize int
+
+	// MaxDataOp bounds the size of a single literal DATA operation; a
+	// longer literal run is emitted as several DATA operations. It does
+	// not bound memory use: CreateDelta reads all of newfile into memory.
+	MaxDataOp int
+
+	// UniqueHasher builds the strong hash used to disambiguate weak
+	// checksum collisions. Defaults to MD5 when nil.
+	UniqueHasher func() hash.Hash
+
+	// HashID records which algorithm UniqueHasher implements, so a codec
+	// can persist it in a signature/delta header and a later patch can
+	// reconstruct a matching UniqueHasher without being told again.
+	// Left empty, it is treated the same as HashMD5.
+	HashID HashID
+}
+
+func (rs *RSync) strongHasher() func() hash.Hash {
+	if rs.UniqueHasher != nil {
+		return rs.UniqueHasher
+	}
+	return md5.New
+}
+
+// CreateSignature splits basis into BlockSize blocks and invokes
+// blockHandler with the weak/strong checksum pair of each one, in order.
+func (rs *RSync) CreateSignature(basis io.Reader, blockHandler func(block BlockHash) error) error {
+	if rs.BlockSize <= 0 {
+		return ErrInvalidBlockSize
+	}
+	newHash := rs.strongHasher()
+	buf := make([]byte, rs.BlockSize)
+	var index uint64
+	for {
+		n, err := io.ReadFull(basis, buf)
+		if n > 0 {
+			block := buf[:n]
+			weak, _ := weakChecksum(block)
+			strong := newHash()
+			strong.Write(block)
+			if err := blockHandler(BlockHash{
+				Index:      index,
+				WeakHash:   weak,
+				StrongHash: strong.Sum(nil),
+				Length:     uint32(n),
+			}); err != nil {
+				return err
+			}
+			index++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// blockLookup indexes signature blocks by weak checksum so CreateDelta can
+// test candidate matches as it rolls across the new file.
+type blockLookup map[uint32][]BlockHash
+
+func buildLookup(hl []BlockHash) blockLookup {
+	m := make(blockLookup, len(hl))
+	for _, b := range hl {
+		m[b.WeakHash] = append(m[b.WeakHash], b)
+	}
+	return m
+}
+
+// CreateDelta compares newfile against the basis blocks described by hl,
+// emitting a BLOCK operation for each unchanged basis block and a DATA
+// operation for everything else. If hasher is non-nil it is fed every byte
+// of newfile so the caller can append a whole-file HASH operation.
+func (rs *RSync) CreateDelta(newfile io.Reader, hl []BlockHash, opHandler func(op Operation) error, hasher hash.Hash) error {
+	if rs.BlockSize <= 0 {
+		return ErrInvalidBlockSize
+	}
+	lookup := buildLookup(hl)
+	newHash := rs.strongHasher()
+	h := newHash()
+
+	buf, err := io.ReadAll(newfile)
+	if err != nil {
+		return err
+	}
+	if hasher != nil {
+		hasher.Write(buf)
+	}
+
+	var literal []byte
+	flushLiteral := func() error {
+		for len(literal) > 0 {
+			n := len(literal)
+			if rs.MaxDataOp > 0 && n > rs.MaxDataOp {
+				n = rs.MaxDataOp
+			}
+			if err := opHandler(Operation{Type: DATA, Data: literal[:n]}); err != nil {
+				return err
+			}
+			literal = literal[n:]
+		}
+		return nil
+	}
+
+	// a and b are the rolling checksum's components for the window
+	// buf[i:end], valid only while rolling is true. Sliding the window
+	// forward one byte via rollChecksum is O(1); recomputing weakChecksumAB
+	// from scratch is O(BlockSize), which would make this loop
+	// O(len(buf)*BlockSize) instead of O(len(buf)) on a run of non-matching
+	// bytes.
+	var a, b uint32
+	rolling := false
+
+	i := 0
+	for i < len(buf) {
+		end := i + rs.BlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		window := buf[i:end]
+		if !rolling {
+			a, b = weakChecksumAB(window)
+		}
+		weak := a | (b << 16)
+		matched := false
+		if candidates, ok := lookup[weak]; ok {
+			h.Reset()
+			h.Write(window)
+			strong := h.Sum(nil)
+			for _, c := range candidates {
+				if int(c.Length) == len(window) && bytes.Equal(c.StrongHash, strong) {
+					if err := flushLiteral(); err != nil {
+						return err
+					}
+					if err := opHandler(Operation{
+						Type:        BLOCK,
+						BlockIndex:  c.Index,
+						BlockOffset: c.Index * uint64(rs.BlockSize),
+						BlockLength: c.Length,
+					}); err != nil {
+						return err
+					}
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			i = end
+			rolling = false
+			continue
+		}
+		// The window is full-size and another full window starts at i+1:
+		// roll the checksum forward instead of recomputing it there.
+		if end-i == rs.BlockSize && end < len(buf) {
+			a, b = rollChecksum(a, b, buf[i], buf[end], rs.BlockSize)
+			rolling = true
+		} else {
+			rolling = false
+		}
+		literal = append(literal, buf[i])
+		i++
+	}
+	return flushLiteral()
+}
+
+// ApplyDelta reconstructs the new file by copying blocks from basis and
+// literal data from ops, in order, into target. basis must support seeking
+// to arbitrary block offsets. If hasher is non-nil it is fed every byte
+// written, so the caller can compare it against a trailing HASH operation.
+//
+// RSync.BlockSize is only consulted for BLOCK operations that don't carry
+// their own BlockOffset/BlockLength (e.g. a codec that addresses basis
+// blocks purely by index); a delta whose every BLOCK operation is
+// self-describing can be applied with a zero-value BlockSize.
+func (rs *RSync) ApplyDelta(target io.Writer, basis io.ReaderAt, ops <-chan Operation, hasher hash.Hash) error {
+	var buf []byte
+	if rs.BlockSize > 0 {
+		buf = make([]byte, rs.BlockSize)
+	}
+	write := func(p []byte) error {
+		if _, err := target.Write(p); err != nil {
+			return err
+		}
+		if hasher != nil {
+			hasher.Write(p)
+		}
+		return nil
+	}
+	for op := range ops {
+		switch op.Type {
+		case BLOCK:
+			if op.BlockLength > 0 {
+				chunk := make([]byte, op.BlockLength)
+				n, err := basis.ReadAt(chunk, int64(op.BlockOffset))
+				if err != nil && err != io.EOF {
+					return err
+				}
+				if err := write(chunk[:n]); err != nil {
+					return err
+				}
+				continue
+			}
+			if rs.BlockSize <= 0 {
+				return ErrInvalidBlockSize
+			}
+			n, err := basis.ReadAt(buf, int64(op.BlockIndex)*int64(rs.BlockSize))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err := write(buf[:n]); err != nil {
+				return err
+			}
+		case DATA:
+			if err := write(op.Data); err != nil {
+				return err
+			}
+		default:
+			return ErrUnknownOperation
+		}
+	}
+	return nil
+}